@@ -0,0 +1,162 @@
+package endpoint
+
+import (
+	"time"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/mongo-go-driver/bson/primitive"
+	"github.com/pritunl/pritunl-zero/database"
+	"github.com/pritunl/pritunl-zero/errortypes"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	DocTypeStatistic uint16 = 1
+	DocTypeLog       uint16 = 2
+)
+
+// docCodec decodes a doc type's msgpack payload into a typed struct and
+// applies it to the endpoint. Doc types register themselves in init()
+// below rather than being switched on inline, so ProcessDoc never needs
+// to change when a new telemetry kind is added.
+type docCodec struct {
+	new     func() interface{}
+	process func(db *database.Database, endpt *Endpoint, doc interface{}) error
+}
+
+var docCodecs = map[uint16]*docCodec{}
+
+func registerDocCodec(docType uint16, codec *docCodec) {
+	docCodecs[docType] = codec
+}
+
+// ProcessDoc decodes a binary frame payload with the codec registered
+// for its doc type and applies it to endpt.
+func ProcessDoc(db *database.Database, endpt *Endpoint, docType uint16,
+	payload []byte) (err error) {
+
+	codec, ok := docCodecs[docType]
+	if !ok {
+		err = &errortypes.ParseError{
+			errors.Newf("endpoint: Unknown doc type %d", docType),
+		}
+		return
+	}
+
+	doc := codec.new()
+
+	err = msgpack.Unmarshal(payload, doc)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "endpoint: Failed to unmarshal doc"),
+		}
+		return
+	}
+
+	err = codec.process(db, endpt, doc)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// ProcessLegacyDoc handles the pre-framing "docType:payload" text
+// messages still sent by agents that haven't upgraded to the binary
+// protocol. Kept for backward compatibility; new doc types only need to
+// register a docCodec, not a branch here.
+func ProcessLegacyDoc(db *database.Database, endpt *Endpoint,
+	docType, doc string) (err error) {
+
+	switch docType {
+	case "statistic":
+		err = processStatistic(db, endpt, &Statistic{
+			Timestamp: time.Now(),
+			Raw:       doc,
+		})
+	case "log":
+		err = processLog(db, endpt, &Log{
+			Timestamp: time.Now(),
+			Message:   doc,
+		})
+	default:
+		err = &errortypes.ParseError{
+			errors.Newf("endpoint: Unknown legacy doc type %s", docType),
+		}
+	}
+
+	return
+}
+
+// Statistic is a single telemetry sample reported by an endpoint agent,
+// persisted to the endpoint_statistics collection.
+type Statistic struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty" msgpack:"-"`
+	EndpointId primitive.ObjectID `bson:"endpoint_id" msgpack:"-"`
+	Timestamp  time.Time          `bson:"timestamp" msgpack:"timestamp"`
+	Cpu        float64            `bson:"cpu" msgpack:"cpu"`
+	Memory     float64            `bson:"memory" msgpack:"memory"`
+	Raw        string             `bson:"raw,omitempty" msgpack:"raw,omitempty"`
+}
+
+// Log is a single agent log line forwarded for centralized storage,
+// persisted to the endpoint_logs collection.
+type Log struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty" msgpack:"-"`
+	EndpointId primitive.ObjectID `bson:"endpoint_id" msgpack:"-"`
+	Timestamp  time.Time          `bson:"timestamp" msgpack:"timestamp"`
+	Level      string             `bson:"level" msgpack:"level"`
+	Message    string             `bson:"message" msgpack:"message"`
+}
+
+func processStatistic(db *database.Database, endpt *Endpoint,
+	doc interface{}) (err error) {
+
+	stat := doc.(*Statistic)
+	stat.Id = primitive.NewObjectID()
+	stat.EndpointId = endpt.Id
+
+	coll := db.EndpointStatistics()
+
+	_, err = coll.InsertOne(db, stat)
+	if err != nil {
+		err = database.ParseError(err)
+		return
+	}
+
+	return
+}
+
+func processLog(db *database.Database, endpt *Endpoint,
+	doc interface{}) (err error) {
+
+	lg := doc.(*Log)
+	lg.Id = primitive.NewObjectID()
+	lg.EndpointId = endpt.Id
+
+	coll := db.EndpointLogs()
+
+	_, err = coll.InsertOne(db, lg)
+	if err != nil {
+		err = database.ParseError(err)
+		return
+	}
+
+	return
+}
+
+func init() {
+	registerDocCodec(DocTypeStatistic, &docCodec{
+		new: func() interface{} {
+			return &Statistic{}
+		},
+		process: processStatistic,
+	})
+
+	registerDocCodec(DocTypeLog, &docCodec{
+		new: func() interface{} {
+			return &Log{}
+		},
+		process: processLog,
+	})
+}
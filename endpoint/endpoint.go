@@ -0,0 +1,152 @@
+package endpoint
+
+import (
+	"github.com/dropbox/godropbox/container/set"
+	"github.com/pritunl/mongo-go-driver/bson"
+	"github.com/pritunl/mongo-go-driver/bson/primitive"
+	"github.com/pritunl/pritunl-zero/database"
+	"github.com/pritunl/pritunl-zero/errortypes"
+)
+
+// Endpoint is an agent registered to stream telemetry and command
+// responses over the /endpoint/:endpoint_id/comm WebSocket.
+type Endpoint struct {
+	Id           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name         string             `bson:"name" json:"name"`
+	Type         string             `bson:"type" json:"type"`
+	Key          string             `bson:"key" json:"key"`
+	Roles        []string           `bson:"roles" json:"roles"`
+	Organization primitive.ObjectID `bson:"organization,omitempty" json:"organization"`
+
+	// These fields override the default ping/pong/write timing and write
+	// queue depth for this endpoint's WebSocket. Zero values fall back
+	// to the package defaults in NewSocketConfig.
+	PingInterval  int `bson:"ping_interval" json:"ping_interval"`
+	PingWait      int `bson:"ping_wait" json:"ping_wait"`
+	WriteTimeout  int `bson:"write_timeout" json:"write_timeout"`
+	WriteQueueLen int `bson:"write_queue_len" json:"write_queue_len"`
+}
+
+// Validate checks the endpoint is well formed before insert/update. It
+// follows the same errData/error split used throughout the admin models
+// so handlers can surface a 400 without treating it as a server error.
+func (e *Endpoint) Validate(db *database.Database) (
+	errData *errortypes.ErrorData, err error) {
+
+	if e.Name == "" {
+		errData = &errortypes.ErrorData{
+			Error:   "name_required",
+			Message: "Name is required",
+		}
+		return
+	}
+
+	return
+}
+
+func (e *Endpoint) Insert(db *database.Database) (err error) {
+	coll := db.Endpoints()
+
+	_, err = coll.InsertOne(db, e)
+	if err != nil {
+		err = database.ParseError(err)
+		return
+	}
+
+	return
+}
+
+func (e *Endpoint) CommitFields(db *database.Database, fields set.Set) (
+	err error) {
+
+	coll := db.Endpoints()
+
+	err = coll.CommitFields(e.Id, e, fields)
+	if err != nil {
+		err = database.ParseError(err)
+		return
+	}
+
+	return
+}
+
+func Get(db *database.Database, endpointId primitive.ObjectID) (
+	endpt *Endpoint, err error) {
+
+	coll := db.Endpoints()
+	endpt = &Endpoint{}
+
+	err = coll.FindOneId(endpointId, endpt)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func GetAllPaged(db *database.Database, query *bson.M, page, pageCount int64) (
+	endpoints []*Endpoint, count int64, err error) {
+
+	coll := db.Endpoints()
+
+	count, err = coll.CountDocuments(db, query)
+	if err != nil {
+		err = database.ParseError(err)
+		return
+	}
+
+	cursor, err := coll.Find(db, query, database.Paginate(page, pageCount)...)
+	if err != nil {
+		err = database.ParseError(err)
+		return
+	}
+	defer cursor.Close(db)
+
+	endpoints = []*Endpoint{}
+	for cursor.Next(db) {
+		endpt := &Endpoint{}
+		err = cursor.Decode(endpt)
+		if err != nil {
+			err = database.ParseError(err)
+			return
+		}
+
+		endpoints = append(endpoints, endpt)
+	}
+
+	return
+}
+
+func Remove(db *database.Database, endpointId primitive.ObjectID) (
+	err error) {
+
+	coll := db.Endpoints()
+
+	_, err = coll.DeleteOne(db, &bson.M{
+		"_id": endpointId,
+	})
+	if err != nil {
+		err = database.ParseError(err)
+		return
+	}
+
+	return
+}
+
+func RemoveMulti(db *database.Database, endpointIds []primitive.ObjectID) (
+	err error) {
+
+	coll := db.Endpoints()
+
+	_, err = coll.DeleteMany(db, &bson.M{
+		"_id": &bson.M{
+			"$in": endpointIds,
+		},
+	})
+	if err != nil {
+		err = database.ParseError(err)
+		return
+	}
+
+	return
+}
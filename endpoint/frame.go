@@ -0,0 +1,96 @@
+package endpoint
+
+import (
+	"encoding/binary"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-zero/errortypes"
+)
+
+const (
+	// ProtocolVersion1 is the current binary frame layout: version byte,
+	// 2-byte doc type id, 4-byte big-endian payload length, msgpack
+	// payload. Bumped whenever the header layout itself changes; doc
+	// type codecs can evolve independently.
+	ProtocolVersion1 = byte(1)
+
+	frameHeaderLen = 1 + 2 + 4
+
+	// MaxFrameSize bounds a single decoded frame. Telemetry docs are
+	// small; anything past this is either a misbehaving agent or an
+	// attempt to exhaust memory with a bogus length field.
+	MaxFrameSize = 4 * 1024 * 1024
+)
+
+// Frame is a single decoded binary message off the endpoint WebSocket.
+// Mode selection (binary vs legacy text) is implicit in the WebSocket
+// message type, so no separate handshake round trip is needed: agents
+// that speak the binary protocol send BinaryMessage frames, and the
+// version byte inside the frame lets the header layout evolve without
+// breaking doc type codecs.
+type Frame struct {
+	Version byte
+	DocType uint16
+	Payload []byte
+}
+
+// DecodeFrame parses the binary wire format that replaced the
+// "docType:payload" text messages. The length is validated against
+// MaxFrameSize and the actual buffer size before the payload slice is
+// ever handed to a codec, so a forged length field can't be used to
+// over-allocate downstream.
+func DecodeFrame(raw []byte) (frame *Frame, err error) {
+	if len(raw) < frameHeaderLen {
+		err = &errortypes.ParseError{
+			errors.New("endpoint: Frame shorter than header"),
+		}
+		return
+	}
+
+	version := raw[0]
+	if version != ProtocolVersion1 {
+		err = &errortypes.ParseError{
+			errors.Newf("endpoint: Unsupported frame version %d", version),
+		}
+		return
+	}
+
+	docType := binary.BigEndian.Uint16(raw[1:3])
+	payloadLen := binary.BigEndian.Uint32(raw[3:7])
+
+	if payloadLen > MaxFrameSize-frameHeaderLen {
+		err = &errortypes.ParseError{
+			errors.Newf(
+				"endpoint: Frame payload %d exceeds max size %d",
+				payloadLen, MaxFrameSize-frameHeaderLen),
+		}
+		return
+	}
+
+	if uint32(len(raw)-frameHeaderLen) != payloadLen {
+		err = &errortypes.ParseError{
+			errors.New("endpoint: Frame payload length mismatch"),
+		}
+		return
+	}
+
+	frame = &Frame{
+		Version: version,
+		DocType: docType,
+		Payload: raw[frameHeaderLen:],
+	}
+
+	return
+}
+
+// EncodeFrame is the inverse of DecodeFrame, used when pushing
+// server-originated messages (e.g. command responses) back to an agent.
+func EncodeFrame(version byte, docType uint16, payload []byte) []byte {
+	buf := make([]byte, frameHeaderLen+len(payload))
+	buf[0] = version
+	binary.BigEndian.PutUint16(buf[1:3], docType)
+	binary.BigEndian.PutUint32(buf[3:7], uint32(len(payload)))
+	copy(buf[frameHeaderLen:], payload)
+
+	return buf
+}
@@ -0,0 +1,217 @@
+package endpoint
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	DefaultWriteTimeout = 10 * time.Second
+	DefaultPingInterval = 30 * time.Second
+	DefaultPingWait     = 40 * time.Second
+
+	// DefaultWriteQueueLen bounds how many server-originated messages can
+	// be queued for a single slow agent before Send starts
+	// dropping the oldest queued frame rather than blocking the reader
+	// or the ping ticker.
+	DefaultWriteQueueLen = 64
+)
+
+// SocketConfig holds the per-endpoint timing that used to be the package
+// level endpointWriteTimeout/endpointPingInterval/endpointPingWait
+// constants in mhandlers. An endpoint doc can override any of them so a
+// chatty or high-latency agent doesn't need the same deadlines as every
+// other one.
+type SocketConfig struct {
+	WriteTimeout  time.Duration
+	PingInterval  time.Duration
+	PingWait      time.Duration
+	WriteQueueLen int
+}
+
+// NewSocketConfig builds a SocketConfig from an endpoint's overrides,
+// falling back to the package defaults for any field left at zero.
+func NewSocketConfig(endpt *Endpoint) *SocketConfig {
+	cfg := &SocketConfig{
+		WriteTimeout:  DefaultWriteTimeout,
+		PingInterval:  DefaultPingInterval,
+		PingWait:      DefaultPingWait,
+		WriteQueueLen: DefaultWriteQueueLen,
+	}
+
+	if endpt.WriteTimeout > 0 {
+		cfg.WriteTimeout = time.Duration(endpt.WriteTimeout) * time.Second
+	}
+	if endpt.PingInterval > 0 {
+		cfg.PingInterval = time.Duration(endpt.PingInterval) * time.Second
+	}
+	if endpt.PingWait > 0 {
+		cfg.PingWait = time.Duration(endpt.PingWait) * time.Second
+	}
+	if endpt.WriteQueueLen > 0 {
+		cfg.WriteQueueLen = endpt.WriteQueueLen
+	}
+
+	return cfg
+}
+
+// SocketMetrics is a snapshot of one WebSocket's traffic counters,
+// surfaced on the node keepalive record so the admin UI can see which
+// endpoints are backpressured without attaching a profiler.
+type SocketMetrics struct {
+	BytesIn       int64     `json:"bytes_in"`
+	BytesOut      int64     `json:"bytes_out"`
+	DroppedFrames int64     `json:"dropped_frames"`
+	LastPong      time.Time `json:"last_pong"`
+}
+
+// WebSocket tracks the live state of a single endpoint agent connection
+// so endpointCommGet's reader/writer goroutines and the ping ticker can
+// all be torn down together from one place. Outbound writes go through
+// writeCh rather than calling conn.WriteMessage directly, so the writer
+// goroutine is the only one touching the connection and pings can never
+// race a server-originated message.
+type WebSocket struct {
+	Conn   *websocket.Conn
+	Ticker *time.Ticker
+	Cancel context.CancelFunc
+
+	Config *SocketConfig
+
+	writeCh  chan []byte
+	writeMu  sync.Mutex
+	bytesIn  int64
+	bytesOut int64
+	dropped  int64
+	lastPong atomic.Value // time.Time
+}
+
+// NewWebSocket allocates a WebSocket with its outbound write queue sized
+// per cfg.WriteQueueLen.
+func NewWebSocket(cfg *SocketConfig) *WebSocket {
+	w := &WebSocket{
+		Config:  cfg,
+		writeCh: make(chan []byte, cfg.WriteQueueLen),
+	}
+	w.lastPong.Store(time.Now())
+
+	return w
+}
+
+// Send enqueues a server-originated message for the writer goroutine. If
+// the queue is full the oldest pending message is dropped to make room,
+// rather than blocking the caller or growing without bound against a
+// stalled agent.
+func (w *WebSocket) Send(data []byte) {
+	select {
+	case w.writeCh <- data:
+	default:
+		select {
+		case <-w.writeCh:
+			atomic.AddInt64(&w.dropped, 1)
+		default:
+		}
+
+		select {
+		case w.writeCh <- data:
+		default:
+			atomic.AddInt64(&w.dropped, 1)
+		}
+	}
+}
+
+// WriteLoop is the sole goroutine permitted to call conn.WriteMessage,
+// serializing queued Send() payloads and ticker-driven pings so they
+// never interleave on the wire.
+func (w *WebSocket) WriteLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.Ticker.C:
+			w.writeMu.Lock()
+			err := w.Conn.WriteControl(websocket.PingMessage, []byte{},
+				time.Now().Add(w.Config.WriteTimeout))
+			w.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		case data := <-w.writeCh:
+			w.writeMu.Lock()
+			err := w.Conn.SetWriteDeadline(time.Now().Add(w.Config.WriteTimeout))
+			if err == nil {
+				err = w.Conn.WriteMessage(websocket.BinaryMessage, data)
+			}
+			w.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+
+			atomic.AddInt64(&w.bytesOut, int64(len(data)))
+		}
+	}
+}
+
+// RecordRead accounts an inbound message's size against the bytesIn
+// counter. It does not touch the read deadline - that's set directly on
+// conn by the caller (mhandlers.endpointCommGet) after upgrade and again
+// from the pong handler, since gorilla requires SetReadDeadline to be
+// called on the *websocket.Conn itself rather than through a side timer.
+func (w *WebSocket) RecordRead(n int) {
+	atomic.AddInt64(&w.bytesIn, int64(n))
+}
+
+// RecordPong marks that a pong was just received, for the last-pong-age
+// metric. The caller's pong handler is also responsible for extending
+// conn's read deadline; see RecordRead.
+func (w *WebSocket) RecordPong() {
+	w.lastPong.Store(time.Now())
+}
+
+// Metrics returns a point-in-time snapshot of this socket's counters.
+func (w *WebSocket) Metrics() SocketMetrics {
+	return SocketMetrics{
+		BytesIn:       atomic.LoadInt64(&w.bytesIn),
+		BytesOut:      atomic.LoadInt64(&w.bytesOut),
+		DroppedFrames: atomic.LoadInt64(&w.dropped),
+		LastPong:      w.lastPong.Load().(time.Time),
+	}
+}
+
+func (w *WebSocket) Close() {
+	if w.Ticker != nil {
+		w.Ticker.Stop()
+	}
+
+	if w.Cancel != nil {
+		w.Cancel()
+	}
+
+	if w.Conn != nil {
+		w.Conn.Close()
+	}
+}
+
+// AllMetrics aggregates SocketMetrics across every live endpoint
+// WebSocket, for node.keepalive to attach to its record.
+func AllMetrics() map[string]SocketMetrics {
+	WebSocketsLock.Lock()
+	defer WebSocketsLock.Unlock()
+
+	metrics := map[string]SocketMetrics{}
+
+	for _, item := range WebSockets.List() {
+		socket, ok := item.(*WebSocket)
+		if !ok || socket.Conn == nil {
+			continue
+		}
+
+		metrics[socket.Conn.RemoteAddr().String()] = socket.Metrics()
+	}
+
+	return metrics
+}
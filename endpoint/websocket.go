@@ -0,0 +1,12 @@
+package endpoint
+
+import (
+	"sync"
+
+	"github.com/dropbox/godropbox/container/set"
+)
+
+var (
+	WebSockets     = set.NewSet()
+	WebSocketsLock = sync.Mutex{}
+)
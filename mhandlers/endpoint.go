@@ -22,12 +22,6 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-const (
-	endpointWriteTimeout = 10 * time.Second
-	endpointPingInterval = 30 * time.Second
-	endpointPingWait     = 40 * time.Second
-)
-
 type endpointData struct {
 	Id    primitive.ObjectID `json:"id"`
 	Name  string             `json:"name"`
@@ -250,7 +244,6 @@ func endpointsGet(c *gin.Context) {
 
 func endpointCommGet(c *gin.Context) {
 	db := c.MustGet("db").(*database.Database)
-	socket := &endpoint.WebSocket{}
 
 	endpointId, ok := utils.ParseObjectId(c.Param("endpoint_id"))
 	if !ok {
@@ -264,6 +257,8 @@ func endpointCommGet(c *gin.Context) {
 		return
 	}
 
+	socket := endpoint.NewWebSocket(endpoint.NewSocketConfig(endpt))
+
 	defer func() {
 		socket.Close()
 		endpoint.WebSocketsLock.Lock()
@@ -288,7 +283,7 @@ func endpointCommGet(c *gin.Context) {
 	}
 	socket.Conn = conn
 
-	err = conn.SetReadDeadline(time.Now().Add(endpointPingWait))
+	err = conn.SetReadDeadline(time.Now().Add(socket.Config.PingWait))
 	if err != nil {
 		err = &errortypes.RequestError{
 			errors.Wrap(err, "mhandlers: Failed to set read deadline"),
@@ -298,7 +293,9 @@ func endpointCommGet(c *gin.Context) {
 	}
 
 	conn.SetPongHandler(func(x string) (err error) {
-		err = conn.SetReadDeadline(time.Now().Add(endpointPingWait))
+		socket.RecordPong()
+
+		err = conn.SetReadDeadline(time.Now().Add(socket.Config.PingWait))
 		if err != nil {
 			err = &errortypes.RequestError{
 				errors.Wrap(err, "mhandlers: Failed to set read deadline"),
@@ -310,13 +307,22 @@ func endpointCommGet(c *gin.Context) {
 		return
 	})
 
-	ticker := time.NewTicker(endpointPingInterval)
-	socket.Ticker = ticker
+	// Reject oversized messages before gorilla buffers the full payload,
+	// rather than after conn.ReadMessage has already allocated it.
+	conn.SetReadLimit(endpoint.MaxFrameSize)
+
+	socket.Ticker = time.NewTicker(socket.Config.PingInterval)
+
+	// The writer goroutine is the only one that calls conn.WriteMessage,
+	// so ticker-driven pings and Send()-queued server messages never
+	// race each other on the connection.
+	go socket.WriteLoop(ctx)
 
 	go func() {
 		defer func() {
 			recover()
 		}()
+		defer socket.Cancel()
 		for {
 			msgType, msgByte, err := conn.ReadMessage()
 			if err != nil {
@@ -324,21 +330,42 @@ func endpointCommGet(c *gin.Context) {
 				return
 			}
 
-			if msgType != websocket.TextMessage {
-				continue
-			}
+			socket.RecordRead(len(msgByte))
+
+			switch msgType {
+			case websocket.BinaryMessage:
+				// Mode is implicit in the WebSocket message type, so a
+				// binary agent needs no separate handshake round trip:
+				// the frame's own version byte covers future header
+				// changes.
+				frame, e := endpoint.DecodeFrame(msgByte)
+				if e != nil {
+					logrus.WithFields(logrus.Fields{
+						"error": e,
+					}).Error("mhandlers: Failed to decode frame")
+
+					conn.Close()
+					return
+				}
+
+				err = endpoint.ProcessDoc(db, endpt, frame.DocType,
+					frame.Payload)
+			case websocket.TextMessage:
+				msg := string(msgByte)
 
-			msg := string(msgByte)
+				sepIndex := strings.Index(msg, ":")
+				if sepIndex == -1 {
+					continue
+				}
+
+				docType := msg[:sepIndex]
+				doc := msg[sepIndex+1:]
 
-			sepIndex := strings.Index(msg, ":")
-			if sepIndex == -1 {
+				err = endpoint.ProcessLegacyDoc(db, endpt, docType, doc)
+			default:
 				continue
 			}
 
-			docType := msg[:sepIndex]
-			doc := msg[sepIndex+1:]
-
-			err = endpoint.ProcessDoc(db, endpt, docType, doc)
 			if err != nil {
 				logrus.WithFields(logrus.Fields{
 					"error": err,
@@ -350,20 +377,5 @@ func endpointCommGet(c *gin.Context) {
 		}
 	}()
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			err = conn.WriteControl(websocket.PingMessage, []byte{},
-				time.Now().Add(endpointWriteTimeout))
-			if err != nil {
-				err = &errortypes.RequestError{
-					errors.Wrap(err,
-						"mhandlers: Failed to set write control"),
-				}
-				return
-			}
-		}
-	}
+	<-ctx.Done()
 }
@@ -0,0 +1,47 @@
+package mhandlers
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pritunl/pritunl-zero/database"
+	"github.com/pritunl/pritunl-zero/node"
+	"github.com/pritunl/pritunl-zero/utils"
+)
+
+var metricsRanges = map[string]time.Duration{
+	"1h":  1 * time.Hour,
+	"6h":  6 * time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+func nodeMetricsGet(c *gin.Context) {
+	db := c.MustGet("db").(*database.Database)
+
+	nodeId := c.Param("id")
+
+	rng := metricsRanges[c.Query("range")]
+	if rng == 0 {
+		rng = 1 * time.Hour
+	}
+
+	resolution := c.Query("resolution")
+	switch resolution {
+	case node.ResolutionMinute, node.ResolutionHour:
+	default:
+		resolution = node.ResolutionRaw
+	}
+
+	end := time.Now()
+	start := end.Add(-rng)
+
+	samples, err := node.GetSamples(db, nodeId, resolution, start, end)
+	if err != nil {
+		utils.AbortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, samples)
+}
@@ -0,0 +1,59 @@
+package mhandlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/pritunl/pritunl-zero/database"
+	"github.com/pritunl/pritunl-zero/demo"
+	"github.com/pritunl/pritunl-zero/search"
+	"github.com/pritunl/pritunl-zero/utils"
+)
+
+type searchDlqData struct {
+	Count int `json:"count"`
+}
+
+func searchDlqGet(c *gin.Context) {
+	db := c.MustGet("db").(*database.Database)
+
+	count, err := search.DlqCount(db)
+	if err != nil {
+		utils.AbortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, &searchDlqData{
+		Count: count,
+	})
+}
+
+func searchDlqRetryPost(c *gin.Context) {
+	if demo.Blocked(c) {
+		return
+	}
+
+	db := c.MustGet("db").(*database.Database)
+
+	err := search.DlqRetryNow(db)
+	if err != nil {
+		utils.AbortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, nil)
+}
+
+func searchDlqDelete(c *gin.Context) {
+	if demo.Blocked(c) {
+		return
+	}
+
+	db := c.MustGet("db").(*database.Database)
+
+	err := search.DlqPurge(db)
+	if err != nil {
+		utils.AbortWithError(c, 500, err)
+		return
+	}
+
+	c.JSON(200, nil)
+}
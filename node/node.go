@@ -1,24 +1,39 @@
 package node
 
 import (
+	"os"
+	"runtime"
+	"time"
+
 	"github.com/Sirupsen/logrus"
 	"github.com/pritunl/pritunl-zero/database"
+	"github.com/pritunl/pritunl-zero/endpoint"
 	"github.com/pritunl/pritunl-zero/utils"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
-	"time"
 )
 
 var Self *Node
 
 type Node struct {
-	Id        string    `bson:"_id" json:"id"`
-	Type      string    `bson:"type" json:"type"`
-	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
-	Memory    float64   `bson:"memory" json:"memory"`
-	Load1     float64   `bson:"load1" json:"load1"`
-	Load5     float64   `bson:"load5" json:"load5"`
-	Load15    float64   `bson:"load15" json:"load15"`
+	Id         string                            `bson:"_id" json:"id"`
+	Type       string                            `bson:"type" json:"type"`
+	Timestamp  time.Time                         `bson:"timestamp" json:"timestamp"`
+	Memory     float64                           `bson:"memory" json:"memory"`
+	Load1      float64                           `bson:"load1" json:"load1"`
+	Load5      float64                           `bson:"load5" json:"load5"`
+	Load15     float64                           `bson:"load15" json:"load15"`
+	Disk       map[string]float64                `bson:"disk" json:"disk"`
+	NetRx      uint64                            `bson:"net_rx" json:"net_rx"`
+	NetTx      uint64                            `bson:"net_tx" json:"net_tx"`
+	OpenFds    int64                             `bson:"open_fds" json:"open_fds"`
+	Goroutines int                               `bson:"goroutines" json:"goroutines"`
+	Cpus       []float64                         `bson:"cpus" json:"cpus"`
+	Sockets    map[string]endpoint.SocketMetrics `bson:"sockets" json:"sockets"`
 }
 
 func (n *Node) update(db *database.Database) (err error) {
@@ -27,11 +42,18 @@ func (n *Node) update(db *database.Database) (err error) {
 	change := mgo.Change{
 		Update: &bson.M{
 			"$set": &bson.M{
-				"timestamp": n.Timestamp,
-				"memory":    n.Memory,
-				"load1":     n.Load1,
-				"load5":     n.Load5,
-				"load15":    n.Load15,
+				"timestamp":  n.Timestamp,
+				"memory":     n.Memory,
+				"load1":      n.Load1,
+				"load5":      n.Load5,
+				"load15":     n.Load15,
+				"disk":       n.Disk,
+				"net_rx":     n.NetRx,
+				"net_tx":     n.NetTx,
+				"open_fds":   n.OpenFds,
+				"goroutines": n.Goroutines,
+				"cpus":       n.Cpus,
+				"sockets":    n.Sockets,
 			},
 		},
 		Upsert:    true,
@@ -81,6 +103,56 @@ func (n *Node) keepalive() {
 			n.Load15 = load.Load15
 		}
 
+		usage, err := diskUsage()
+		if err != nil {
+			n.Disk = map[string]float64{}
+
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("node: Failed to get disk usage")
+		} else {
+			n.Disk = usage
+		}
+
+		rx, tx, err := netCounters()
+		if err != nil {
+			n.NetRx = 0
+			n.NetTx = 0
+
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("node: Failed to get network counters")
+		} else {
+			n.NetRx = rx
+			n.NetTx = tx
+		}
+
+		fds, err := openFds()
+		if err != nil {
+			n.OpenFds = 0
+
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("node: Failed to get open fd count")
+		} else {
+			n.OpenFds = fds
+		}
+
+		n.Goroutines = runtime.NumGoroutine()
+
+		cpus, err := cpu.Percent(0, true)
+		if err != nil {
+			n.Cpus = []float64{}
+
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("node: Failed to get per-cpu usage")
+		} else {
+			n.Cpus = cpus
+		}
+
+		n.Sockets = endpoint.AllMetrics()
+
 		err = n.update(db)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
@@ -88,10 +160,68 @@ func (n *Node) keepalive() {
 			}).Error("node: Failed to update node")
 		}
 
+		err = insertSample(db, n)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("node: Failed to insert node sample")
+		}
+
 		time.Sleep(1 * time.Second)
 	}
 }
 
+// diskUsage returns used-percent per mounted partition, for the
+// nodes_samples disk field and the admin metrics graph.
+func diskUsage() (usage map[string]float64, err error) {
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		return
+	}
+
+	usage = map[string]float64{}
+	for _, partition := range partitions {
+		stat, e := disk.Usage(partition.Mountpoint)
+		if e != nil {
+			continue
+		}
+
+		usage[partition.Mountpoint] = stat.UsedPercent
+	}
+
+	return
+}
+
+// netCounters sums RX/TX bytes across every network interface.
+func netCounters() (rx, tx uint64, err error) {
+	counters, err := net.IOCounters(true)
+	if err != nil {
+		return
+	}
+
+	for _, counter := range counters {
+		rx += counter.BytesRecv
+		tx += counter.BytesSent
+	}
+
+	return
+}
+
+// openFds returns the number of file descriptors held by this process.
+func openFds() (fds int64, err error) {
+	proc, err := process.NewProcess(int32(os.Getpid()))
+	if err != nil {
+		return
+	}
+
+	fds, err = proc.NumFDs()
+	if err != nil {
+		return
+	}
+
+	return
+}
+
 func (n *Node) Init() (err error) {
 	db := database.GetDatabase()
 	defer db.Close()
@@ -99,6 +229,7 @@ func (n *Node) Init() (err error) {
 	Self = n
 
 	go n.keepalive()
+	go downsampleWorker()
 
 	return
 }
@@ -0,0 +1,270 @@
+package node
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pritunl/pritunl-zero/database"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func logDownsampleErr(err error, resolution string) {
+	logrus.WithFields(logrus.Fields{
+		"error":      err,
+		"resolution": resolution,
+	}).Error("node: Failed to downsample node samples")
+}
+
+// Resolutions a sample can be stored/queried at. Raw samples are taken
+// every keepalive tick; the downsample worker rolls them up into
+// progressively coarser buckets as they age out of their tier's
+// retention window.
+const (
+	ResolutionRaw    = "1s"
+	ResolutionMinute = "1m"
+	ResolutionHour   = "1h"
+)
+
+// retention is how long samples at each resolution are kept before
+// being rolled up (raw, minute) or deleted outright (hour).
+var retention = map[string]time.Duration{
+	ResolutionRaw:    1 * time.Hour,
+	ResolutionMinute: 7 * 24 * time.Hour,
+	ResolutionHour:   90 * 24 * time.Hour,
+}
+
+const downsampleInterval = 1 * time.Minute
+
+// Sample is a single point in a node's metrics time series, persisted
+// to the nodes_samples collection at one of the resolutions above.
+// Retention is enforced by rollup/expire deleting aged-out documents,
+// not by a MongoDB capped collection - deletes are forbidden against a
+// capped collection, so nodes_samples must be a regular collection.
+type Sample struct {
+	Id         bson.ObjectId      `bson:"_id"`
+	NodeId     string             `bson:"node_id"`
+	Resolution string             `bson:"resolution"`
+	Timestamp  time.Time          `bson:"timestamp"`
+	Memory     float64            `bson:"memory"`
+	Load1      float64            `bson:"load1"`
+	Load5      float64            `bson:"load5"`
+	Load15     float64            `bson:"load15"`
+	Disk       map[string]float64 `bson:"disk"`
+	NetRx      uint64             `bson:"net_rx"`
+	NetTx      uint64             `bson:"net_tx"`
+	OpenFds    int64              `bson:"open_fds"`
+	Goroutines int                `bson:"goroutines"`
+	Cpus       []float64          `bson:"cpus"`
+}
+
+func newSample(n *Node, resolution string) *Sample {
+	return &Sample{
+		Id:         bson.NewObjectId(),
+		NodeId:     n.Id,
+		Resolution: resolution,
+		Timestamp:  n.Timestamp,
+		Memory:     n.Memory,
+		Load1:      n.Load1,
+		Load5:      n.Load5,
+		Load15:     n.Load15,
+		Disk:       n.Disk,
+		NetRx:      n.NetRx,
+		NetTx:      n.NetTx,
+		OpenFds:    n.OpenFds,
+		Goroutines: n.Goroutines,
+		Cpus:       n.Cpus,
+	}
+}
+
+func insertSample(db *database.Database, n *Node) (err error) {
+	coll := db.NodesSamples()
+
+	err = coll.Insert(newSample(n, ResolutionRaw))
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// GetSamples returns the stored samples for nodeId at resolution within
+// [start, end], for the /node/:id/metrics admin endpoint.
+func GetSamples(db *database.Database, nodeId, resolution string,
+	start, end time.Time) (samples []*Sample, err error) {
+
+	coll := db.NodesSamples()
+
+	samples = []*Sample{}
+	err = coll.Find(&bson.M{
+		"node_id":    nodeId,
+		"resolution": resolution,
+		"timestamp": &bson.M{
+			"$gte": start,
+			"$lte": end,
+		},
+	}).Sort("timestamp").All(&samples)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// downsampleWorker rolls up raw samples into minute buckets once they
+// age past the raw tier's retention, and minute buckets into hour
+// buckets once they age past the minute tier's retention, deleting the
+// finer-grained documents once their rollup has been written. Hour
+// samples are only ever deleted once they age out of the hour tier.
+func downsampleWorker() {
+	for {
+		time.Sleep(downsampleInterval)
+
+		db := database.GetDatabase()
+
+		err := rollup(db, ResolutionRaw, ResolutionMinute, time.Minute)
+		if err != nil {
+			logDownsampleErr(err, ResolutionRaw)
+		}
+
+		err = rollup(db, ResolutionMinute, ResolutionHour, time.Hour)
+		if err != nil {
+			logDownsampleErr(err, ResolutionMinute)
+		}
+
+		err = expire(db, ResolutionHour)
+		if err != nil {
+			logDownsampleErr(err, ResolutionHour)
+		}
+
+		db.Close()
+	}
+}
+
+// rollup averages every fromResolution sample older than its tier's
+// retention window into one toResolution bucket per bucketSize
+// interval, writes the buckets, then deletes the source samples that
+// were just rolled up.
+func rollup(db *database.Database, fromResolution, toResolution string,
+	bucketSize time.Duration) (err error) {
+
+	coll := db.NodesSamples()
+	cutoff := time.Now().Add(-retention[fromResolution])
+
+	samples := []*Sample{}
+	err = coll.Find(&bson.M{
+		"resolution": fromResolution,
+		"timestamp": &bson.M{
+			"$lt": cutoff,
+		},
+	}).Sort("timestamp").All(&samples)
+	if err != nil {
+		return
+	}
+
+	if len(samples) == 0 {
+		return
+	}
+
+	buckets := map[string][]*Sample{}
+	for _, sample := range samples {
+		key := sample.NodeId + "|" +
+			sample.Timestamp.Truncate(bucketSize).String()
+		buckets[key] = append(buckets[key], sample)
+	}
+
+	for _, bucket := range buckets {
+		avg := averageBucket(bucket)
+		avg.Id = bson.NewObjectId()
+		avg.Resolution = toResolution
+		avg.Timestamp = bucket[0].Timestamp.Truncate(bucketSize)
+
+		err = coll.Insert(avg)
+		if err != nil {
+			return
+		}
+	}
+
+	ids := make([]bson.ObjectId, len(samples))
+	for i, sample := range samples {
+		ids[i] = sample.Id
+	}
+
+	_, err = coll.RemoveAll(&bson.M{
+		"_id": &bson.M{
+			"$in": ids,
+		},
+	})
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// averageBucket takes the mean of every field across samples. Integer
+// fields (NetRx, NetTx, OpenFds, Goroutines) are summed in full first and
+// divided once at the end - dividing each term by the sample count before
+// summing would truncate any value smaller than the bucket size down to
+// zero. Float fields are divided by the sample count term by term.
+func averageBucket(samples []*Sample) *Sample {
+	avg := &Sample{
+		NodeId: samples[0].NodeId,
+		Disk:   map[string]float64{},
+	}
+
+	count := len(samples)
+	countf := float64(count)
+
+	var netRx, netTx, openFds, goroutines int64
+
+	for _, sample := range samples {
+		avg.Memory += sample.Memory / countf
+		avg.Load1 += sample.Load1 / countf
+		avg.Load5 += sample.Load5 / countf
+		avg.Load15 += sample.Load15 / countf
+		netRx += int64(sample.NetRx)
+		netTx += int64(sample.NetTx)
+		openFds += sample.OpenFds
+		goroutines += int64(sample.Goroutines)
+
+		for mount, used := range sample.Disk {
+			avg.Disk[mount] += used / countf
+		}
+
+		if len(avg.Cpus) == 0 {
+			avg.Cpus = make([]float64, len(sample.Cpus))
+		}
+		for i, pct := range sample.Cpus {
+			if i < len(avg.Cpus) {
+				avg.Cpus[i] += pct / countf
+			}
+		}
+	}
+
+	avg.NetRx = uint64(netRx / int64(count))
+	avg.NetTx = uint64(netTx / int64(count))
+	avg.OpenFds = openFds / int64(count)
+	avg.Goroutines = int(goroutines / int64(count))
+
+	return avg
+}
+
+// expire deletes samples at resolution older than its retention window.
+// Only the coarsest tier reaches this path; finer tiers are cleared out
+// by rollup() once they've been aggregated into the next tier up.
+func expire(db *database.Database, resolution string) (err error) {
+	coll := db.NodesSamples()
+	cutoff := time.Now().Add(-retention[resolution])
+
+	_, err = coll.RemoveAll(&bson.M{
+		"resolution": resolution,
+		"timestamp": &bson.M{
+			"$lt": cutoff,
+		},
+	})
+	if err != nil {
+		return
+	}
+
+	return
+}
@@ -0,0 +1,206 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/olivere/elastic/v7"
+	"github.com/pritunl/pritunl-zero/errortypes"
+	"github.com/pritunl/pritunl-zero/settings"
+)
+
+// SearchBackend abstracts over the Elasticsearch and OpenSearch clients so
+// search can target either without branching on vendor everywhere. All
+// methods operate against the write alias, never a concrete index name.
+type SearchBackend interface {
+	WriteAlias() string
+	Bulk(ctx context.Context, requests []elastic.BulkableRequest) (
+		*elastic.BulkResponse, error)
+	EnsureTemplate(ctx context.Context) (err error)
+	EnsureRollover(ctx context.Context) (err error)
+	Close()
+}
+
+type esBackend struct {
+	clnt  *elastic.Client
+	alias string
+}
+
+// WriteAlias returns the index/alias name Index() should target. In
+// rollover mode this is the stable alias the backend keeps pointed at the
+// current write index. In daily mode it is the concrete per-day index
+// name, recomputed on every call (not cached on b.alias) so writes follow
+// the UTC day boundary instead of sticking to the day the backend was
+// constructed on.
+func (b *esBackend) WriteAlias() string {
+	if settings.Elastic.IndexMode == IndexModeDaily {
+		return dailyIndex()
+	}
+
+	return b.alias
+}
+
+func (b *esBackend) Bulk(ctx context.Context,
+	requests []elastic.BulkableRequest) (*elastic.BulkResponse, error) {
+
+	bulk := b.clnt.Bulk()
+	for _, request := range requests {
+		bulk.Add(request)
+	}
+
+	return bulk.Do(ctx)
+}
+
+// EnsureTemplate installs the index template that governs mappings and
+// settings for every index matched by the write alias pattern. Templates
+// are sourced from settings so operators can tune analyzers/shards without
+// a binary change.
+func (b *esBackend) EnsureTemplate(ctx context.Context) (err error) {
+	name := templateName(b.alias)
+
+	tmpl := settings.Elastic.Template
+	if tmpl == "" {
+		tmpl = defaultTemplate(b.alias)
+	}
+
+	body := map[string]interface{}{}
+	err = json.Unmarshal([]byte(tmpl), &body)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "search: Failed to parse index template"),
+		}
+		return
+	}
+
+	_, err = b.clnt.IndexPutIndexTemplate(name).BodyJson(body).Do(ctx)
+	if err != nil {
+		err = errortypes.DatabaseError{
+			errors.Wrap(err, "search: Failed to put index template"),
+		}
+		return
+	}
+
+	if settings.Elastic.IlmEnabled {
+		err = b.ensureIlmPolicy(ctx)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (b *esBackend) ensureIlmPolicy(ctx context.Context) (err error) {
+	policyName := ilmPolicyName(b.alias)
+
+	policy := settings.Elastic.IlmPolicy
+	if policy == "" {
+		policy = defaultIlmPolicy()
+	}
+
+	body := map[string]interface{}{}
+	err = json.Unmarshal([]byte(policy), &body)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "search: Failed to parse ilm policy"),
+		}
+		return
+	}
+
+	req, err := b.clnt.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "PUT",
+		Path:   "/_ilm/policy/" + policyName,
+		Body:   body,
+	})
+	if err != nil || req.StatusCode >= 300 {
+		err = errortypes.DatabaseError{
+			errors.Wrap(err, "search: Failed to put ilm policy"),
+		}
+		return
+	}
+
+	return
+}
+
+// EnsureRollover makes sure the write alias exists, backed by an initial
+// rollover index (zero-requests-000001), and triggers a rollover when the
+// configured size/age thresholds have been exceeded.
+func (b *esBackend) EnsureRollover(ctx context.Context) (err error) {
+	exists, err := b.clnt.Alias().Alias(b.alias).Do(ctx)
+	aliasExists := err == nil && exists != nil
+
+	if !aliasExists {
+		initial := b.alias + "-000001"
+
+		_, err = b.clnt.CreateIndex(initial).BodyJson(map[string]interface{}{
+			"aliases": map[string]interface{}{
+				b.alias: map[string]interface{}{
+					"is_write_index": true,
+				},
+			},
+		}).Do(ctx)
+		if err != nil {
+			err = errortypes.DatabaseError{
+				errors.Wrap(err,
+					"search: Failed to create initial rollover index"),
+			}
+			return
+		}
+
+		return
+	}
+
+	conditions := map[string]interface{}{}
+	if settings.Elastic.RolloverMaxSize != "" {
+		conditions["max_size"] = settings.Elastic.RolloverMaxSize
+	}
+	if settings.Elastic.RolloverMaxAge != "" {
+		conditions["max_age"] = settings.Elastic.RolloverMaxAge
+	}
+	if len(conditions) == 0 {
+		return
+	}
+
+	_, err = b.clnt.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   "/" + b.alias + "/_rollover",
+		Body: map[string]interface{}{
+			"conditions": conditions,
+		},
+	})
+	if err != nil {
+		err = errortypes.DatabaseError{
+			errors.Wrap(err, "search: Failed to rollover index"),
+		}
+		return
+	}
+
+	return
+}
+
+func (b *esBackend) Close() {
+	if b.clnt != nil {
+		b.clnt.Stop()
+	}
+}
+
+func newEsBackend(addrs []string) (bknd SearchBackend, err error) {
+	clnt, err := elastic.NewClient(
+		elastic.SetSniff(false),
+		elastic.SetURL(addrs...),
+	)
+	if err != nil {
+		err = errortypes.DatabaseError{
+			errors.Wrap(err, "search: Failed to create elastic client"),
+		}
+		return
+	}
+
+	bknd = &esBackend{
+		clnt:  clnt,
+		alias: baseIndex,
+	}
+
+	return
+}
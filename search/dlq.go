@@ -0,0 +1,289 @@
+package search
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dropbox/godropbox/errors"
+	"github.com/olivere/elastic/v7"
+	"github.com/pritunl/pritunl-zero/database"
+	"github.com/pritunl/pritunl-zero/errortypes"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	dlqBackoffBase = 500 * time.Millisecond
+	dlqBackoffCap  = 5 * time.Minute
+	dlqDrainLimit  = 100
+
+	// dlqMaxAttempts is where the reprocessor gives up on a document.
+	// Past this it is left in search_failed (removable through the admin
+	// handlers, and reset by DlqRetryNow) but excluded from the retryable
+	// query, so a
+	// poison doc at the head of the created-sorted window can't stall
+	// every other queued document behind it forever.
+	dlqMaxAttempts = 20
+)
+
+// failedDoc is the durable record of a queued index request that could
+// not be written after the worker's inline retries were exhausted. It is
+// stored in search_failed so a restart does not lose the backlog, and
+// drained in the background by reprocessFailed(). NextRetry is advanced
+// by a full-jitter backoff on every failed attempt so the reprocessor
+// can skip a doc until it's actually due, rather than blocking on it.
+type failedDoc struct {
+	Id        bson.ObjectId `bson:"_id"`
+	Index     string        `bson:"index"`
+	Type      string        `bson:"type"`
+	DocId     string        `bson:"doc_id"`
+	Doc       interface{}   `bson:"doc"`
+	Attempts  int           `bson:"attempts"`
+	Created   time.Time     `bson:"created"`
+	NextRetry time.Time     `bson:"next_retry"`
+}
+
+// retryNowCh lets DlqRetryNow wake the background reprocessor instead of
+// draining the queue inline on the admin request goroutine.
+var retryNowCh = make(chan struct{}, 1)
+
+// jitterBackoff implements min(cap, base*2^n) * rand(), the full-jitter
+// schedule used both by the worker's inline retry loop and the
+// dead-letter reprocessor so a degraded cluster isn't hammered in
+// lockstep by every retrying goroutine.
+func jitterBackoff(base, cap time.Duration, n int) time.Duration {
+	exp := base * time.Duration(math.Pow(2, float64(n)))
+	if exp <= 0 || exp > cap {
+		exp = cap
+	}
+
+	return time.Duration(rand.Int63n(int64(exp) + 1))
+}
+
+func enqueueFailed(docs []*queuedDoc) {
+	db := database.GetDatabase()
+	defer db.Close()
+
+	coll := db.SearchFailed()
+
+	now := time.Now()
+
+	for _, doc := range docs {
+		err := coll.Insert(&failedDoc{
+			Id:        bson.NewObjectId(),
+			Index:     doc.index,
+			Type:      doc.typ,
+			DocId:     doc.id,
+			Doc:       doc.doc,
+			Created:   now,
+			NextRetry: now,
+		})
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("search: Failed to persist doc to dead-letter queue")
+		}
+	}
+}
+
+// reprocessFailed drains search_failed in the background, retrying each
+// due document against the current backend. Failures advance that
+// document's NextRetry by a full-jitter backoff instead of blocking this
+// loop, so one slow/poison document never holds up the rest of the
+// drain. DlqRetryNow wakes the idle wait early; it never drains inline.
+func reprocessFailed() {
+	for {
+		bknd := backend
+		if bknd == nil {
+			waitOrTriggered(dlqBackoffBase)
+			continue
+		}
+
+		db := database.GetDatabase()
+		docs, err := dlqPeekRetryable(db, dlqDrainLimit)
+		db.Close()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("search: Failed to read dead-letter queue")
+			waitOrTriggered(dlqBackoffCap)
+			continue
+		}
+
+		if len(docs) == 0 {
+			waitOrTriggered(dlqBackoffBase)
+			continue
+		}
+
+		for _, doc := range docs {
+			retryFailedDoc(bknd, doc)
+		}
+	}
+}
+
+// waitOrTriggered sleeps for d, or returns early if DlqRetryNow signals
+// retryNowCh in the meantime.
+func waitOrTriggered(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-retryNowCh:
+	}
+}
+
+// dlqPeekRetryable is DlqPeek narrowed to documents that are actually
+// due (NextRetry has passed) and haven't exceeded dlqMaxAttempts, so the
+// background loop never spins on a doc it just backed off or gave up on.
+func dlqPeekRetryable(db *database.Database, limit int) (
+	docs []*failedDoc, err error) {
+
+	coll := db.SearchFailed()
+
+	docs = []*failedDoc{}
+	err = coll.Find(&bson.M{
+		"attempts": &bson.M{
+			"$lt": dlqMaxAttempts,
+		},
+		"next_retry": &bson.M{
+			"$lte": time.Now(),
+		},
+	}).Sort("created").Limit(limit).All(&docs)
+	if err != nil {
+		err = errortypes.DatabaseError{
+			errors.Wrap(err, "search: Failed to query dead-letter queue"),
+		}
+		return
+	}
+
+	return
+}
+
+func retryFailedDoc(bknd SearchBackend, doc *failedDoc) {
+	db := database.GetDatabase()
+	defer db.Close()
+
+	coll := db.SearchFailed()
+
+	request := elastic.NewBulkIndexRequest().Index(doc.Index).
+		Type(doc.Type).Id(doc.DocId).Doc(doc.Doc)
+
+	_, err := bknd.Bulk(context.Background(),
+		[]elastic.BulkableRequest{request})
+	if err != nil {
+		doc.Attempts++
+		doc.NextRetry = time.Now().Add(
+			jitterBackoff(dlqBackoffBase, dlqBackoffCap, doc.Attempts))
+
+		err = coll.UpdateId(doc.Id, &bson.M{
+			"$set": &bson.M{
+				"attempts":   doc.Attempts,
+				"next_retry": doc.NextRetry,
+			},
+		})
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("search: Failed to update dead-letter queue attempts")
+		}
+
+		if doc.Attempts >= dlqMaxAttempts {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"doc_id":   doc.DocId,
+				"attempts": doc.Attempts,
+			}).Error("search: Giving up on dead-letter doc, leaving for manual retry")
+		}
+
+		return
+	}
+
+	err = coll.RemoveId(doc.Id)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("search: Failed to remove reprocessed dead-letter doc")
+	}
+}
+
+// DlqPeek returns up to limit oldest dead-lettered documents, whether or
+// not they are due for retry. The background reprocessor reads through
+// dlqPeekRetryable instead.
+func DlqPeek(db *database.Database, limit int) (docs []*failedDoc, err error) {
+	coll := db.SearchFailed()
+
+	docs = []*failedDoc{}
+	err = coll.Find(nil).Sort("created").Limit(limit).All(&docs)
+	if err != nil {
+		err = errortypes.DatabaseError{
+			errors.Wrap(err, "search: Failed to query dead-letter queue"),
+		}
+		return
+	}
+
+	return
+}
+
+// DlqCount returns the current depth of the dead-letter queue, for the
+// admin handler's status view.
+func DlqCount(db *database.Database) (count int, err error) {
+	count, err = db.SearchFailed().Find(nil).Count()
+	if err != nil {
+		err = errortypes.DatabaseError{
+			errors.Wrap(err, "search: Failed to count dead-letter queue"),
+		}
+		return
+	}
+
+	return
+}
+
+// DlqPurge removes every pending dead-lettered document without retrying
+// them. Used by the admin handler when the backlog is known to be stale.
+func DlqPurge(db *database.Database) (err error) {
+	_, err = db.SearchFailed().RemoveAll(nil)
+	if err != nil {
+		err = errortypes.DatabaseError{
+			errors.Wrap(err, "search: Failed to purge dead-letter queue"),
+		}
+		return
+	}
+
+	return
+}
+
+// DlqRetryNow makes every dead-lettered document due immediately,
+// resetting its attempts so documents the reprocessor gave up on are
+// retried too, then wakes the background reprocessor rather than waiting
+// for its next idle cycle, for the admin "retry now" action. The actual
+// drain always happens on the reprocessFailed goroutine so a down
+// cluster can't block the admin request goroutine behind hundreds of
+// backed-off documents.
+func DlqRetryNow(db *database.Database) (err error) {
+	if backend == nil {
+		err = errortypes.DatabaseError{
+			errors.New("search: No search backend configured"),
+		}
+		return
+	}
+
+	_, err = db.SearchFailed().UpdateAll(nil, &bson.M{
+		"$set": &bson.M{
+			"attempts":   0,
+			"next_retry": time.Now(),
+		},
+	})
+	if err != nil {
+		err = errortypes.DatabaseError{
+			errors.Wrap(err, "search: Failed to reset dead-letter queue"),
+		}
+		return
+	}
+
+	select {
+	case retryNowCh <- struct{}{}:
+	default:
+	}
+
+	return
+}
@@ -5,131 +5,65 @@ import (
 	"container/list"
 	"context"
 	"crypto/md5"
+	"io"
+	"sync"
+	"time"
+
 	"github.com/Sirupsen/logrus"
-	"github.com/dropbox/godropbox/errors"
-	"github.com/pritunl/pritunl-zero/errortypes"
+	"github.com/olivere/elastic/v7"
 	"github.com/pritunl/pritunl-zero/requires"
 	"github.com/pritunl/pritunl-zero/settings"
 	"gopkg.in/mgo.v2/bson"
-	"gopkg.in/olivere/elastic.v5"
-	"io"
-	"sync"
-	"time"
 )
 
 var (
-	ctx          = context.Background()
-	client       *elastic.Client
-	buffer       = list.New()
-	failedBuffer = []*elastic.BulkIndexRequest{}
-	lock         = sync.Mutex{}
-	failedLock   = sync.Mutex{}
+	ctx     = context.Background()
+	backend SearchBackend
+	buffer  = list.New()
+	lock    = sync.Mutex{}
 )
 
-type mapping struct {
-	Field string
-	Type  string
-	Store bool
-	Index string
+// queuedDoc pairs a bulk request with the index/type/id/doc it was built
+// from so a failed bulk can be handed to the dead-letter queue without
+// having to decode it back out of the elastic request.
+type queuedDoc struct {
+	bulk  elastic.BulkableRequest
+	index string
+	typ   string
+	id    string
+	doc   interface{}
 }
 
+// Index queues a document for the next bulk flush. It always targets the
+// backend's write alias (a rollover alias or the current daily index,
+// depending on settings.Elastic.IndexMode) rather than a fixed index
+// name, so the index argument existing callers already pass is kept for
+// source compatibility but no longer honored literally.
 func Index(index, typ string, data interface{}) {
-	clnt := client
-	if clnt == nil {
+	bknd := backend
+	if bknd == nil {
 		return
 	}
 
 	id := bson.NewObjectId().Hex()
+	index = bknd.WriteAlias()
 
-	request := elastic.NewBulkIndexRequest().Index(index).Type(typ).
-		Id(id).Doc(data)
+	request := elastic.NewBulkIndexRequest().Index(index).
+		Type(typ).Id(id).Doc(data)
 
 	lock.Lock()
-	buffer.PushBack(request)
+	buffer.PushBack(&queuedDoc{
+		bulk:  request,
+		index: index,
+		typ:   typ,
+		id:    id,
+		doc:   data,
+	})
 	lock.Unlock()
 
 	return
 }
 
-func putIndex(clnt *elastic.Client, index string, typ string,
-	mappings []mapping) (err error) {
-
-	exists, err := clnt.IndexExists(index).Do(ctx)
-	if err != nil {
-		err = errortypes.DatabaseError{
-			errors.Wrap(err, "search: Failed to check elastic index"),
-		}
-		return
-	}
-
-	if exists {
-		return
-	}
-
-	properties := map[string]interface{}{}
-
-	for _, mapping := range mappings {
-		if mapping.Type == "object" {
-			properties[mapping.Field] = struct {
-				Enabled bool `json:"enabled"`
-			}{
-				Enabled: false,
-			}
-		} else {
-			properties[mapping.Field] = struct {
-				Type  string `json:"type"`
-				Store bool   `json:"store"`
-				Index string `json:"index"`
-			}{
-				Type:  mapping.Type,
-				Store: mapping.Store,
-				Index: mapping.Index,
-			}
-		}
-	}
-
-	data := struct {
-		Mappings map[string]interface{} `json:"mappings"`
-	}{
-		Mappings: map[string]interface{}{},
-	}
-
-	data.Mappings[typ] = struct {
-		Properties map[string]interface{} `json:"properties"`
-	}{
-		Properties: properties,
-	}
-
-	_, err = clnt.CreateIndex(index).BodyJson(data).Do(ctx)
-	if err != nil {
-		err = errortypes.DatabaseError{
-			errors.Wrap(err, "search: Failed to create elastic index"),
-		}
-		return
-	}
-
-	return
-}
-
-func newClient(addrs []string) (clnt *elastic.Client, err error) {
-	if len(addrs) == 0 {
-		return
-	}
-
-	clnt, err = elastic.NewClient(
-		elastic.SetSniff(false),
-		elastic.SetURL(addrs...),
-	)
-	if err != nil {
-		err = errortypes.DatabaseError{
-			errors.Wrap(err, "search: Failed to create elastic client"),
-		}
-		return
-	}
-
-	return
-}
-
 func hashAddresses(addrs []string) []byte {
 	hash := md5.New()
 
@@ -141,98 +75,49 @@ func hashAddresses(addrs []string) []byte {
 }
 
 func update(addrs []string) (err error) {
-	clnt, err := newClient(addrs)
-	if err != nil {
-		client = nil
+	if len(addrs) == 0 {
+		backend = nil
 		return
 	}
 
-	if clnt == nil {
-		client = nil
+	bknd, err := newEsBackend(addrs)
+	if err != nil {
+		backend = nil
 		return
 	}
 
-	mappings := []mapping{}
-
-	mappings = append(mappings, mapping{
-		Field: "user",
-		Type:  "keyword",
-		Store: false,
-		Index: "analyzed",
-	})
-
-	mappings = append(mappings, mapping{
-		Field: "session",
-		Type:  "keyword",
-		Store: false,
-		Index: "analyzed",
-	})
-
-	mappings = append(mappings, mapping{
-		Field: "address",
-		Type:  "ip",
-		Store: false,
-		Index: "analyzed",
-	})
-
-	mappings = append(mappings, mapping{
-		Field: "timestamp",
-		Type:  "date",
-		Store: false,
-		Index: "analyzed",
-	})
-
-	mappings = append(mappings, mapping{
-		Field: "scheme",
-		Type:  "keyword",
-		Store: false,
-		Index: "analyzed",
-	})
-
-	mappings = append(mappings, mapping{
-		Field: "host",
-		Type:  "keyword",
-		Store: false,
-		Index: "analyzed",
-	})
-
-	mappings = append(mappings, mapping{
-		Field: "path",
-		Type:  "keyword",
-		Store: false,
-		Index: "analyzed",
-	})
-
-	mappings = append(mappings, mapping{
-		Field: "query",
-		Type:  "object",
-	})
-
-	mappings = append(mappings, mapping{
-		Field: "header",
-		Type:  "object",
-	})
-
-	mappings = append(mappings, mapping{
-		Field: "body",
-		Type:  "text",
-		Store: false,
-		Index: "no",
-	})
-
-	err = putIndex(clnt, "zero-requests", "request", mappings)
+	err = bknd.EnsureTemplate(ctx)
 	if err != nil {
-		client = nil
+		backend = nil
 		return
 	}
 
-	client = clnt
+	// Daily mode writes directly into zero-requests-YYYY.MM.DD indices
+	// with no alias/rollover/ILM involved - running EnsureRollover there
+	// would create a "...-000001" index and write alias colliding with
+	// the day's index name.
+	if settings.Elastic.IndexMode == IndexModeRollover {
+		err = bknd.EnsureRollover(ctx)
+		if err != nil {
+			backend = nil
+			return
+		}
+	}
+
+	backend = bknd
 
 	return
 }
 
+// rolloverCheckInterval is how often watchSearch polls EnsureRollover in
+// rollover mode. EnsureRollover costs an alias GET plus a conditional
+// _rollover POST, so it's checked far less often than the address hash
+// that drives watchSearch's own 1-second loop.
+const rolloverCheckInterval = 30 * time.Second
+
 func watchSearch() {
 	hash := hashAddresses([]string{})
+	lastRolloverCheck := time.Time{}
 
 	for {
 		addrs := settings.Elastic.Addresses
@@ -249,6 +134,18 @@ func watchSearch() {
 			}
 
 			hash = newHash
+		} else if backend != nil &&
+			settings.Elastic.IndexMode == IndexModeRollover &&
+			time.Since(lastRolloverCheck) >= rolloverCheckInterval {
+
+			lastRolloverCheck = time.Now()
+
+			err := backend.EnsureRollover(ctx)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": err,
+				}).Error("search: Failed to check index rollover")
+			}
 		}
 
 		time.Sleep(1 * time.Second)
@@ -259,36 +156,34 @@ func worker() {
 	for {
 		time.Sleep(2 * time.Second)
 
-		requests := []*elastic.BulkIndexRequest{}
+		docs := []*queuedDoc{}
 
 		lock.Lock()
 		for elem := buffer.Front(); elem != nil; elem = elem.Next() {
-			request := elem.Value.(*elastic.BulkIndexRequest)
-			requests = append(requests, request)
+			docs = append(docs, elem.Value.(*queuedDoc))
 		}
 		buffer = list.New()
 		lock.Unlock()
 
-		clnt := client
-		if client == nil {
+		bknd := backend
+		if bknd == nil {
 			continue
 		}
 
-		if len(requests) == 0 {
+		if len(docs) == 0 {
 			continue
 		}
 
+		requests := make([]elastic.BulkableRequest, len(docs))
+		for i, doc := range docs {
+			requests[i] = doc.bulk
+		}
+
 		var err error
 		for i := 0; i < 10; i++ {
-			bulk := clnt.Bulk()
-
-			for _, request := range requests {
-				bulk.Add(request)
-			}
-
-			_, err = bulk.Do(ctx)
+			_, err = bknd.Bulk(ctx, requests)
 			if err != nil {
-				time.Sleep(1 * time.Second)
+				time.Sleep(jitterBackoff(dlqBackoffBase, dlqBackoffCap, i))
 				continue
 			}
 
@@ -297,15 +192,11 @@ func worker() {
 		}
 
 		if err != nil {
-			failedLock.Lock()
-			failedBuffer = append(failedBuffer, requests...)
-			failedLock.Unlock()
+			enqueueFailed(docs)
 
 			logrus.WithFields(logrus.Fields{
 				"error": err,
-			}).Error("search: Bulk insert failed, moving to failed buffer")
-
-			err = nil
+			}).Error("search: Bulk insert failed, moving to dead-letter queue")
 		}
 	}
 }
@@ -317,6 +208,7 @@ func init() {
 	module.Handler = func() (err error) {
 		go watchSearch()
 		go worker()
+		go reprocessFailed()
 		return
 	}
-}
\ No newline at end of file
+}
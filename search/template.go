@@ -0,0 +1,102 @@
+package search
+
+import (
+	"time"
+)
+
+const (
+	// IndexModeRollover aliases zero-requests-000001, zero-requests-000002,
+	// ... behind a single write alias managed by EnsureRollover. The ILM
+	// policy is not attached to these indices by the default template.
+	IndexModeRollover = "rollover"
+
+	// IndexModeDaily writes directly into zero-requests-YYYY.MM.DD indices,
+	// one per UTC day, with no rollover/ILM involved.
+	IndexModeDaily = "daily"
+
+	baseIndex = "zero-requests"
+	docType   = "request"
+)
+
+// dailyIndex returns the concrete per-day index name for "now", recomputed
+// on every call rather than cached, since the index it names rolls over at
+// each UTC day boundary without the backend itself being rebuilt.
+func dailyIndex() string {
+	return baseIndex + "-" + time.Now().UTC().Format("2006.01.02")
+}
+
+func templateName(alias string) string {
+	return alias + "-template"
+}
+
+func ilmPolicyName(alias string) string {
+	return alias + "-ilm"
+}
+
+// defaultTemplate is used when settings.Elastic.Template is unset. It
+// mirrors the mappings previously built inline in update(): analyzed
+// keyword/date/ip fields for the structured request metadata, unindexed
+// object fields for the free-form query/header maps, and an unindexed
+// body field so payloads are stored but never analyzed.
+func defaultTemplate(alias string) string {
+	return `{
+  "index_patterns": ["` + alias + `-*", "` + alias + `"],
+  "template": {
+    "settings": {
+      "number_of_shards": 1,
+      "number_of_replicas": 1
+    },
+    "mappings": {
+      "properties": {
+        "user": {"type": "keyword"},
+        "session": {"type": "keyword"},
+        "address": {"type": "ip"},
+        "timestamp": {"type": "date"},
+        "scheme": {"type": "keyword"},
+        "host": {"type": "keyword"},
+        "path": {"type": "keyword"},
+        "query": {"type": "object", "enabled": false},
+        "header": {"type": "object", "enabled": false},
+        "body": {"type": "text", "index": false}
+      }
+    }
+  }
+}`
+}
+
+// defaultIlmPolicy moves indices from hot to warm after 7 days, then
+// deletes them after 90, matching the retention pritunl-zero ships with
+// out of the box. Operators override via settings.Elastic.IlmPolicy.
+// ensureIlmPolicy installs it when settings.Elastic.IlmEnabled is set, but
+// defaultTemplate does not set index.lifecycle.name, so an index follows
+// the policy only when a template from settings.Elastic.Template names it.
+func defaultIlmPolicy() string {
+	return `{
+  "policy": {
+    "phases": {
+      "hot": {
+        "actions": {
+          "rollover": {
+            "max_size": "50gb",
+            "max_age": "1d"
+          }
+        }
+      },
+      "warm": {
+        "min_age": "7d",
+        "actions": {
+          "shrink": {
+            "number_of_shards": 1
+          }
+        }
+      },
+      "delete": {
+        "min_age": "90d",
+        "actions": {
+          "delete": {}
+        }
+      }
+    }
+  }
+}`
+}